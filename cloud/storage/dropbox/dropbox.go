@@ -8,11 +8,21 @@ package dropbox // import "dropbox.upspin.io/cloud/storage/dropbox"
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/dropbox/dropbox-sdk-go-unofficial/v6/dropbox"
+	"github.com/dropbox/dropbox-sdk-go-unofficial/v6/dropbox/files"
+	"golang.org/x/oauth2"
 
 	"upspin.io/cloud/storage"
 	"upspin.io/errors"
@@ -20,8 +30,138 @@ import (
 )
 
 // apiToken is the key for the dial options in the storage.Storage interface.
+// Its value is either a bare Dropbox access token, kept for backward
+// compatibility with existing deployments, or a JSON-encoded tokenData for
+// accounts set up with offline access (see New).
 const apiToken = "token"
 
+// clientIDOpt and clientSecretOpt identify the Dropbox app used to mint the
+// token. They are required only when the token carries a refresh token, and
+// are written alongside it by upspin-setupstorage-dropbox.
+const (
+	clientIDOpt     = "client_id"
+	clientSecretOpt = "client_secret"
+)
+
+// tokenFileOpt, if set, is a path that a refreshed token is written to, so
+// that it survives a server restart. See fileTokenStore.
+const tokenFileOpt = "token_file"
+
+// dropboxOAuthEndpoint is the OAuth2 endpoint used to refresh an access
+// token from a refresh token.
+var dropboxOAuthEndpoint = oauth2.Endpoint{
+	AuthURL:  "https://www.dropbox.com/oauth2/authorize",
+	TokenURL: "https://api.dropboxapi.com/oauth2/token",
+}
+
+// tokenRefresher exchanges a refresh token for a new access token. New
+// wires it to the real oauth2 token endpoint; tests inject a fake to
+// exercise the refresh-on-401 path without a network round trip.
+type tokenRefresher interface {
+	RefreshToken(refreshToken string) (*oauth2.Token, error)
+}
+
+// oauthRefresher is the production tokenRefresher, backed by conf's token
+// endpoint.
+type oauthRefresher struct {
+	conf *oauth2.Config
+}
+
+func (r oauthRefresher) RefreshToken(refreshToken string) (*oauth2.Token, error) {
+	// A token with no AccessToken is never Valid, so this TokenSource
+	// always exchanges the refresh token rather than reusing a cached
+	// access token.
+	return r.conf.TokenSource(context.Background(), &oauth2.Token{RefreshToken: refreshToken}).Token()
+}
+
+// tokenData is the JSON form of the "token" dial option for accounts set up
+// with offline access: an access token, the refresh token used to mint a
+// new one, and the access token's expiry.
+type tokenData struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	Expiry       time.Time `json:"expiry,omitempty"`
+}
+
+func (t tokenData) expired() bool {
+	return !t.Expiry.IsZero() && !time.Now().Before(t.Expiry)
+}
+
+// parseTokenData reports whether s is a JSON-encoded tokenData carrying a
+// refresh token, as opposed to a legacy bare access token string.
+func parseTokenData(s string) (tokenData, bool) {
+	var td tokenData
+	if err := json.Unmarshal([]byte(s), &td); err != nil || td.AccessToken == "" || td.RefreshToken == "" {
+		return tokenData{}, false
+	}
+	return td, true
+}
+
+// TokenStore persists a refreshed token so that upspinserver-dropbox can
+// reuse it across restarts instead of forcing the operator through the
+// authorization flow again. Tests inject a fake implementation to observe
+// refreshes.
+type TokenStore interface {
+	// SaveToken is called with the new value for the "token" dial option
+	// whenever dropboxImpl mints a new access token from a refresh
+	// token.
+	SaveToken(tok string) error
+}
+
+// noopTokenStore discards refreshed tokens. It is used when New is not
+// given a way to persist them.
+type noopTokenStore struct{}
+
+func (noopTokenStore) SaveToken(string) error { return nil }
+
+// fileTokenStore persists a refreshed token by overwriting a file, as named
+// by the tokenFileOpt dial option.
+type fileTokenStore struct {
+	path string
+}
+
+func (f fileTokenStore) SaveToken(tok string) error {
+	return os.WriteFile(f.path, []byte(tok), 0600)
+}
+
+// chunkSizeOpt and concurrencyOpt configure the chunked upload_session flow
+// used for payloads larger than the chunk size. See New for details.
+const (
+	chunkSizeOpt   = "chunk_size"
+	concurrencyOpt = "concurrency"
+)
+
+// pathOpt is a dial option prepended to every ref, letting several Upspin
+// deployments share one Dropbox account, or sandbox Upspin data under a
+// subfolder such as "Apps/Upspin". namespaceIDOpt, if set, targets a team
+// space or shared namespace via the Dropbox-API-Path-Root header.
+const (
+	pathOpt        = "path"
+	namespaceIDOpt = "namespace_id"
+)
+
+// defaultChunkSize is the threshold above which Put switches from the plain
+// Upload call, which Dropbox caps at 150 MB, to the chunked upload_session
+// family. It is comfortably under that cap so a single chunk can always be
+// sent with the plain call's retry semantics.
+const defaultChunkSize = 128 << 20 // 128 MB
+
+// normalizePathPrefix validates and cleans a pathOpt dial option value,
+// returning it without leading or trailing slashes. An empty prefix means
+// the Dropbox account root.
+func normalizePathPrefix(p string) (string, error) {
+	for _, elem := range strings.Split(p, "/") {
+		if elem == ".." {
+			return "", errors.Errorf("%q option must not contain \"..\": %q", pathOpt, p)
+		}
+	}
+	clean := strings.Trim(path.Clean("/"+p), "/")
+	if clean == "." {
+		clean = ""
+	}
+	return clean, nil
+}
+
 // New initializes a Storage implementation that stores data to Dropbox.
 func New(opts *storage.Opts) (storage.Storage, error) {
 	const op errors.Op = "cloud/storage/dropbox.New"
@@ -31,10 +171,60 @@ func New(opts *storage.Opts) (storage.Storage, error) {
 		return nil, errors.E(op, errors.Invalid, errors.Errorf("%q option is required", apiToken))
 	}
 
-	return &dropboxImpl{
-		client: http.DefaultClient,
-		token:  tok,
-	}, nil
+	chunkSize := int64(defaultChunkSize)
+	if v, ok := opts.Opts[chunkSizeOpt]; ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, errors.E(op, errors.Invalid, errors.Errorf("invalid %q option: %q", chunkSizeOpt, v))
+		}
+		chunkSize = n
+	}
+
+	concurrency := 1
+	if v, ok := opts.Opts[concurrencyOpt]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, errors.E(op, errors.Invalid, errors.Errorf("invalid %q option: %q", concurrencyOpt, v))
+		}
+		concurrency = n
+	}
+
+	pathPrefix, err := normalizePathPrefix(opts.Opts[pathOpt])
+	if err != nil {
+		return nil, errors.E(op, errors.Invalid, err)
+	}
+
+	d := &dropboxImpl{
+		chunkSize:   chunkSize,
+		concurrency: concurrency,
+		tokenStore:  noopTokenStore{},
+		pathPrefix:  pathPrefix,
+		namespaceID: opts.Opts[namespaceIDOpt],
+	}
+
+	td, ok := parseTokenData(tok)
+	if !ok {
+		// Legacy bare access token: no refresh is possible.
+		d.tok = tokenData{AccessToken: tok}
+	} else {
+		clientID := opts.Opts[clientIDOpt]
+		clientSecret := opts.Opts[clientSecretOpt]
+		if clientID == "" || clientSecret == "" {
+			return nil, errors.E(op, errors.Invalid, errors.Errorf("%q and %q options are required for a refreshable token", clientIDOpt, clientSecretOpt))
+		}
+		d.tok = td
+		d.refresher = oauthRefresher{conf: &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Endpoint:     dropboxOAuthEndpoint,
+		}}
+		if path, ok := opts.Opts[tokenFileOpt]; ok {
+			d.tokenStore = fileTokenStore{path: path}
+		}
+	}
+
+	d.client = newSDKClient(d)
+	return d, nil
 }
 
 func init() {
@@ -43,8 +233,72 @@ func init() {
 
 // dropboxImpl is an implementation of Storage that connects to a Dropbox backend.
 type dropboxImpl struct {
-	client *http.Client
-	token  string
+	// client is the Dropbox SDK client used to make requests. All
+	// authentication, namespace targeting, and retry logic lives in
+	// dropboxTransport, underneath client's http.Client, rather than in
+	// the SDK's own config, so that a refreshed token or test server can
+	// be swapped in without rebuilding client.
+	client files.Client
+
+	// tokMu guards tok, which is mutated by refresh.
+	tokMu sync.Mutex
+	tok   tokenData
+
+	// refresher is non-nil when tok carries a refresh token, allowing
+	// refresh to mint a new access token when the current one expires
+	// or is rejected.
+	refresher tokenRefresher
+
+	// tokenStore persists tok's JSON encoding whenever refresh rotates
+	// it. It defaults to a no-op.
+	tokenStore TokenStore
+
+	// chunkSize is the maximum number of bytes of a ref's contents that
+	// Put will send in a single request. Payloads larger than chunkSize
+	// are uploaded in chunks using the upload_session endpoints.
+	chunkSize int64
+
+	// concurrency is the number of chunks that may be uploaded in
+	// parallel within a single upload session.
+	concurrency int
+
+	// pathPrefix, if non-empty, is prepended to every ref so that
+	// several Upspin deployments can share one Dropbox account. It never
+	// has leading or trailing slashes.
+	pathPrefix string
+
+	// namespaceID, if non-empty, is sent as the Dropbox-API-Path-Root
+	// header on every request, targeting a team space or shared
+	// namespace.
+	namespaceID string
+
+	// testServerURL, if non-empty, overrides the Dropbox API host so
+	// tests can point requests at an httptest.Server.
+	testServerURL string
+}
+
+// newSDKClient builds the Dropbox SDK client used to issue requests for d.
+func newSDKClient(d *dropboxImpl) files.Client {
+	return files.New(dropbox.Config{
+		Client: &http.Client{Transport: &dropboxTransport{d: d}},
+	})
+}
+
+// refPath returns the Dropbox path for ref, taking pathPrefix into account.
+func (d *dropboxImpl) refPath(ref string) string {
+	if d.pathPrefix == "" {
+		return "/" + ref
+	}
+	return "/" + d.pathPrefix + "/" + ref
+}
+
+// rootPath returns the Dropbox folder path to list, taking pathPrefix into
+// account. The API represents the account root as "", not "/".
+func (d *dropboxImpl) rootPath() string {
+	if d.pathPrefix == "" {
+		return ""
+	}
+	return "/" + d.pathPrefix
 }
 
 var (
@@ -53,6 +307,9 @@ var (
 
 	// Guarantee we implement the storage.Lister interface.
 	_ storage.Lister = (*dropboxImpl)(nil)
+
+	// Guarantee we implement BatchDeleter.
+	_ BatchDeleter = (*dropboxImpl)(nil)
 )
 
 // LinkBase implements Storage.
@@ -64,142 +321,411 @@ func (d *dropboxImpl) LinkBase() (base string, err error) {
 func (d *dropboxImpl) Download(ref string) ([]byte, error) {
 	const op errors.Op = "cloud/storage/dropbox.Download"
 
-	arg, _ := json.Marshal(struct {
-		Path string `json:"path"`
-	}{"/" + ref})
-
-	req, err := d.newRequest("https://content.dropboxapi.com/2/files/download", nil, string(arg))
+	_, content, err := d.client.Download(&files.DownloadArg{Path: d.refPath(ref)})
 	if err != nil {
-		return nil, errors.E(op, errors.Other, err)
+		if dlErr, ok := err.(*files.DownloadAPIError); ok &&
+			dlErr.EndpointError != nil && dlErr.EndpointError.Path != nil &&
+			dlErr.EndpointError.Path.Tag == files.LookupErrorNotFound {
+			return nil, errors.E(op, errors.NotExist, err)
+		}
+		return nil, errors.E(op, errors.IO, err)
 	}
+	defer content.Close()
 
-	data, err := d.doRequest(req)
+	data, err := ioutil.ReadAll(content)
 	if err != nil {
-		if derr, ok := err.(DropboxAPIError); ok && derr.StatusCode() == 404 {
-			return nil, errors.E(op, errors.NotExist, derr)
-		}
-
 		return nil, errors.E(op, errors.IO, err)
 	}
 	return data, nil
 }
 
+// commitFor returns the CommitInfo that tells Dropbox where and how to
+// write ref's contents. It is used both by Put and by the upload_session
+// finish calls.
+func (d *dropboxImpl) commitFor(ref string) files.CommitInfo {
+	ci := *files.NewCommitInfo(d.refPath(ref))
+	ci.Mode = &files.WriteMode{Tagged: dropbox.Tagged{Tag: files.WriteModeOverwrite}}
+	ci.Autorename = true
+	return ci
+}
+
 // Put implements Storage.
 func (d *dropboxImpl) Put(ref string, contents []byte) error {
 	const op errors.Op = "cloud/storage/dropbox.Put"
 
-	arg, _ := json.Marshal(struct {
-		Path   string `json:"path"`
-		Mode   string `json:"mode"`
-		Rename bool   `json:"autorename"`
-		Mute   bool   `json:"mute"`
-	}{
-		"/" + ref,
-		"overwrite",
-		true,
-		false,
-	})
+	// Upload has an upload limit of 150 MB. Anything at or above
+	// chunkSize goes through the chunked upload_session flow instead.
+	if int64(len(contents)) < d.chunkSize {
+		arg := &files.UploadArg{CommitInfo: d.commitFor(ref)}
+		if _, err := d.client.Upload(arg, bytes.NewReader(contents)); err != nil {
+			return errors.E(op, errors.IO, err)
+		}
+		return nil
+	}
 
-	body := bytes.NewReader(contents)
+	if err := d.putSession(ref, contents); err != nil {
+		return errors.E(op, errors.IO, err)
+	}
+	return nil
+}
 
-	// The endpoint has an upload limit of 150 MB which is fine for the Upspin
-	// default blocksize. If the Upspin blocksize is set larger than this limit,
-	// the "upload_session/start" endpoint should be used.
-	req, err := d.newRequest("https://content.dropboxapi.com/2/files/upload", body, string(arg))
+// putSession uploads contents using the upload_session family of calls,
+// chunking the payload into pieces of at most d.chunkSize bytes. If
+// d.concurrency is greater than one, the session is opened in Dropbox's
+// concurrent mode and its chunks are appended in parallel; otherwise chunks
+// are appended one at a time.
+func (d *dropboxImpl) putSession(ref string, contents []byte) error {
+	if d.concurrency > 1 {
+		return d.putSessionConcurrent(ref, contents)
+	}
+
+	first := contents
+	if int64(len(first)) > d.chunkSize {
+		first = contents[:d.chunkSize]
+	}
+
+	start, err := d.client.UploadSessionStart(&files.UploadSessionStartArg{Close: false}, bytes.NewReader(first))
 	if err != nil {
-		return errors.E(op, errors.Other, err)
+		return err
+	}
+	sessionID := start.SessionId
+
+	offset := uint64(len(first))
+	remaining := contents[offset:]
+
+	for int64(len(remaining)) > d.chunkSize {
+		chunk := remaining[:d.chunkSize]
+		if err := d.sessionAppend(sessionID, offset, chunk); err != nil {
+			return err
+		}
+		offset += uint64(len(chunk))
+		remaining = remaining[len(chunk):]
 	}
 
-	_, err = d.doRequest(req)
+	return d.sessionFinish(sessionID, offset, remaining, ref)
+}
+
+// concurrentChunkUnit is the granularity Dropbox requires of every
+// non-final chunk appended to a concurrent upload_session: each must be an
+// exact multiple of 4 MiB. It is a var so tests can shrink it.
+var concurrentChunkUnit int64 = 4 << 20
+
+// concurrentChunkSize rounds chunkSize up to the nearest multiple of
+// concurrentChunkUnit, so putSessionConcurrent never appends a non-final
+// chunk that Dropbox would reject.
+func concurrentChunkSize(chunkSize int64) int64 {
+	n := (chunkSize + concurrentChunkUnit - 1) / concurrentChunkUnit
+	if n < 1 {
+		n = 1
+	}
+	return n * concurrentChunkUnit
+}
+
+// putSessionConcurrent uploads contents using Dropbox's concurrent
+// upload_session mode. Per Dropbox's contract for that mode, the
+// upload_session/start call carries no data, and every chunk but the last
+// appended to the session must be a multiple of concurrentChunkUnit; chunks
+// may then be appended, and the session finished, via finish_batch.
+func (d *dropboxImpl) putSessionConcurrent(ref string, contents []byte) error {
+	startArg := &files.UploadSessionStartArg{
+		Close:       false,
+		SessionType: &files.UploadSessionType{Tagged: dropbox.Tagged{Tag: files.UploadSessionTypeConcurrent}},
+	}
+	start, err := d.client.UploadSessionStart(startArg, bytes.NewReader(nil))
 	if err != nil {
-		return errors.E(op, errors.IO, err)
+		return err
+	}
+
+	if err := d.sessionAppendConcurrent(start.SessionId, 0, contents); err != nil {
+		return err
+	}
+	return d.sessionFinishBatch(start.SessionId, uint64(len(contents)), ref)
+}
+
+// sessionAppend appends a single chunk to an existing, non-concurrent
+// session at the given offset.
+func (d *dropboxImpl) sessionAppend(sessionID string, offset uint64, chunk []byte) error {
+	arg := &files.UploadSessionAppendArg{
+		Cursor: &files.UploadSessionCursor{SessionId: sessionID, Offset: offset},
+		Close:  false,
+	}
+	return d.client.UploadSessionAppendV2(arg, bytes.NewReader(chunk))
+}
+
+// sessionAppendConcurrent appends the remaining chunks of a concurrent
+// session in parallel, each at its own offset. Every chunk but the last is
+// sized to concurrentChunkSize(d.chunkSize), since Dropbox requires all but
+// the final chunk of a concurrent session to be a multiple of
+// concurrentChunkUnit. The Dropbox API allows append_v2 calls for a
+// concurrent session to race; it reassembles the file from each chunk's
+// offset.
+func (d *dropboxImpl) sessionAppendConcurrent(sessionID string, offset uint64, remaining []byte) error {
+	size := concurrentChunkSize(d.chunkSize)
+
+	type chunkOffset struct {
+		offset uint64
+		data   []byte
+	}
+	var chunks []chunkOffset
+	for int64(len(remaining)) > 0 {
+		n := size
+		if int64(len(remaining)) < n {
+			n = int64(len(remaining))
+		}
+		chunks = append(chunks, chunkOffset{offset, remaining[:n]})
+		offset += uint64(n)
+		remaining = remaining[n:]
 	}
 
+	sem := make(chan struct{}, d.concurrency)
+	errc := make(chan error, len(chunks))
+	for _, c := range chunks {
+		c := c
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem }()
+			errc <- d.sessionAppend(sessionID, c.offset, c.data)
+		}()
+	}
+	for range chunks {
+		if err := <-errc; err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// sessionFinish closes a non-concurrent session, committing the final chunk
+// of data to the given ref.
+func (d *dropboxImpl) sessionFinish(sessionID string, offset uint64, lastChunk []byte, ref string) error {
+	commit := d.commitFor(ref)
+	arg := &files.UploadSessionFinishArg{
+		Cursor: &files.UploadSessionCursor{SessionId: sessionID, Offset: offset},
+		Commit: &commit,
+	}
+	_, err := d.client.UploadSessionFinish(arg, bytes.NewReader(lastChunk))
+	return err
+}
+
+// sessionFinishBatch closes a concurrent session, whose chunks were already
+// appended by sessionAppendConcurrent, and polls finish_batch/check until
+// the asynchronous job completes.
+func (d *dropboxImpl) sessionFinishBatch(sessionID string, totalSize uint64, ref string) error {
+	commit := d.commitFor(ref)
+	launch, err := d.client.UploadSessionFinishBatch(&files.UploadSessionFinishBatchArg{
+		Entries: []*files.UploadSessionFinishArg{{
+			Cursor: &files.UploadSessionCursor{SessionId: sessionID, Offset: totalSize},
+			Commit: &commit,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	if launch.Tag == "complete" {
+		return nil
+	}
+
+	for {
+		time.Sleep(time.Second)
+
+		status, err := d.client.UploadSessionFinishBatchCheck(&files.PollArg{AsyncJobId: launch.AsyncJobId})
+		if err != nil {
+			return err
+		}
+		if status.Tag == "complete" {
+			return nil
+		}
+		if status.Tag == "failed" {
+			return errors.Errorf("Dropbox API: upload_session/finish_batch failed for ref %q", ref)
+		}
+	}
+}
+
 // Delete implements Storage.
 func (d *dropboxImpl) Delete(ref string) error {
 	const op errors.Op = "cloud/storage/dropbox.Delete"
 
-	arg, _ := json.Marshal(struct {
-		Path string `json:"path"`
-	}{"/" + ref})
+	if _, err := d.client.DeleteV2(&files.DeleteArg{Path: d.refPath(ref)}); err != nil {
+		return errors.E(op, errors.IO, err)
+	}
+	return nil
+}
+
+// maxBatchDeleteRefs is the most refs the delete_batch endpoint accepts in a
+// single call.
+const maxBatchDeleteRefs = 1000
+
+// BatchDeleter is implemented by Storage backends that can delete many refs
+// in a single round trip. storage.Storage implementations that support it
+// can be accessed via a type assertion, the same way storage.Lister is.
+type BatchDeleter interface {
+	// DeleteBatch deletes refs, which may exceed the backend's per-call
+	// limit. It returns a *DeleteBatchError identifying any refs that
+	// failed to delete; refs that are not mentioned were deleted
+	// successfully.
+	DeleteBatch(refs []upspin.Reference) error
+}
 
-	body := bytes.NewReader(arg)
+// DeleteBatchError reports which refs a DeleteBatch call failed to delete,
+// together with the reason for each.
+type DeleteBatchError struct {
+	Failed map[upspin.Reference]error
+}
 
-	req, err := d.newRequest("https://api.dropboxapi.com/2/files/delete_v2", body, "")
-	if err != nil {
-		return errors.E(op, errors.Other, err)
+func (e *DeleteBatchError) Error() string {
+	return errors.Errorf("Dropbox API: delete_batch: %d refs failed", len(e.Failed)).Error()
+}
+
+// DeleteBatch implements BatchDeleter, grouping refs into delete_batch calls
+// of at most maxBatchDeleteRefs entries and polling delete_batch/check until
+// each asynchronous job completes.
+func (d *dropboxImpl) DeleteBatch(refs []upspin.Reference) error {
+	const op errors.Op = "cloud/storage/dropbox.DeleteBatch"
+
+	failed := make(map[upspin.Reference]error)
+	for len(refs) > 0 {
+		n := len(refs)
+		if n > maxBatchDeleteRefs {
+			n = maxBatchDeleteRefs
+		}
+		batch := refs[:n]
+		refs = refs[n:]
+
+		result, err := d.deleteBatch(batch)
+		if err != nil {
+			return errors.E(op, errors.IO, err)
+		}
+		for ref, rerr := range result {
+			failed[ref] = rerr
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.E(op, errors.IO, &DeleteBatchError{Failed: failed})
+	}
+	return nil
+}
+
+// deleteBatch issues a single delete_batch call for refs, which must number
+// at most maxBatchDeleteRefs, and polls delete_batch/check until it
+// completes. It returns the subset of refs that failed to delete, keyed by
+// the reason reported for each.
+func (d *dropboxImpl) deleteBatch(refs []upspin.Reference) (map[upspin.Reference]error, error) {
+	entries := make([]*files.DeleteArg, len(refs))
+	for i, ref := range refs {
+		entries[i] = &files.DeleteArg{Path: d.refPath(string(ref))}
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	_, err = d.doRequest(req)
+	launch, err := d.client.DeleteBatch(&files.DeleteBatchArg{Entries: entries})
 	if err != nil {
-		return errors.E(op, errors.IO, err)
+		return nil, err
+	}
+	if launch.Tag == "complete" {
+		return deleteBatchFailures(refs, launch.Complete), nil
 	}
 
-	return nil
+	for {
+		time.Sleep(time.Second)
+
+		status, err := d.client.DeleteBatchCheck(&files.PollArg{AsyncJobId: launch.AsyncJobId})
+		if err != nil {
+			return nil, err
+		}
+		if status.Tag == "complete" {
+			return deleteBatchFailures(refs, status.Complete), nil
+		}
+		if status.Tag == "failed" {
+			return nil, errors.Errorf("Dropbox API: delete_batch failed")
+		}
+	}
+}
+
+// deleteBatchFailures matches result's per-entry outcomes back to refs by
+// position, which delete_batch preserves, and returns the refs that did not
+// report success.
+func deleteBatchFailures(refs []upspin.Reference, result *files.DeleteBatchResult) map[upspin.Reference]error {
+	if result == nil {
+		return nil
+	}
+	var failed map[upspin.Reference]error
+	for i, entry := range result.Entries {
+		if entry.Tag == "success" {
+			continue
+		}
+		if failed == nil {
+			failed = make(map[upspin.Reference]error)
+		}
+		failed[refs[i]] = errors.Errorf("Dropbox API: %s", entry.Tag)
+	}
+	return failed
 }
 
 // maxResults specifies the number of references to return from each call to
 // List. It is a variable here so that it may be overridden in tests.
-var maxResults int32 = 1000
+var maxResults uint32 = 1000
 
 // List implements storage.Lister.
 func (d *dropboxImpl) List(token string) (refs []upspin.ListRefsItem, nextToken string, err error) {
 	const op errors.Op = "cloud/storage/dropbox.List"
 
-	u := "https://api.dropboxapi.com/2/files/list_folder"
-	arg, _ := json.Marshal(struct {
-		Path  string `json:"path"`
-		Limit int32  `json:"limit"`
-	}{
-		"",
-		maxResults,
-	})
-
-	if token != "" {
-		u = "https://api.dropboxapi.com/2/files/list_folder/continue"
-		arg, _ = json.Marshal(struct {
-			Cursor string `json:"cursor"`
-		}{token})
-	}
-
-	req, err := d.newRequest(u, bytes.NewReader(arg), "")
+	refs, nextToken, err = d.list(d.rootPath(), false, token)
 	if err != nil {
-		return nil, "", err
+		return nil, "", errors.E(op, errors.IO, err)
 	}
-	req.Header.Set("Content-Type", "application/json")
+	return refs, nextToken, nil
+}
+
+// ListPrefix is like List but restricts results to refs under prefix
+// (relative to the "path" dial option, if any), recursing into
+// subfolders. It lets admin tooling and garbage collection enumerate a
+// subset of the namespace instead of paying for a full listing.
+func (d *dropboxImpl) ListPrefix(prefix, token string) (refs []upspin.ListRefsItem, nextToken string, err error) {
+	const op errors.Op = "cloud/storage/dropbox.ListPrefix"
 
-	body, err := d.doRequest(req)
+	refs, nextToken, err = d.list(d.prefixPath(prefix), true, token)
 	if err != nil {
-		return nil, "", err
+		return nil, "", errors.E(op, errors.IO, err)
 	}
+	return refs, nextToken, nil
+}
 
-	var objs struct {
-		Items []struct {
-			Name string `json:"name"`
-			Size int64  `json:"size"`
-		} `json:"entries"`
-		NextPageToken string `json:"cursor"`
-		More          bool   `json:"has_more"`
+// prefixPath returns the Dropbox folder path for a ListPrefix prefix,
+// taking pathPrefix into account. An empty prefix means the listing root.
+func (d *dropboxImpl) prefixPath(prefix string) string {
+	if prefix == "" {
+		return d.rootPath()
 	}
+	return d.refPath(prefix)
+}
 
-	err = json.Unmarshal(body, &objs)
+// list is the shared implementation of List and ListPrefix: it lists path,
+// recursing into subfolders if recursive is set, or continues a previous
+// listing identified by token.
+func (d *dropboxImpl) list(path string, recursive bool, token string) (refs []upspin.ListRefsItem, nextToken string, err error) {
+	var res *files.ListFolderResult
+	if token == "" {
+		res, err = d.client.ListFolder(&files.ListFolderArg{Path: path, Recursive: recursive, Limit: maxResults})
+	} else {
+		res, err = d.client.ListFolderContinue(&files.ListFolderContinueArg{Cursor: token})
+	}
 	if err != nil {
 		return nil, "", err
 	}
 
-	for _, item := range objs.Items {
+	for _, entry := range res.Entries {
+		fm, ok := entry.(*files.FileMetadata)
+		if !ok {
+			// Skip folders and deleted entries; Upspin only lists refs.
+			continue
+		}
 		refs = append(refs, upspin.ListRefsItem{
-			Ref:  upspin.Reference(item.Name),
-			Size: item.Size,
+			Ref:  upspin.Reference(fm.Name),
+			Size: int64(fm.Size),
 		})
 	}
 
-	if objs.More {
-		nextToken = objs.NextPageToken
+	if res.HasMore {
+		nextToken = res.Cursor
 	}
 
 	return refs, nextToken, nil
@@ -210,63 +736,129 @@ func (d *dropboxImpl) Close() {
 	// not yet implemented
 }
 
-func (d *dropboxImpl) newRequest(path string, body io.Reader, arg string) (*http.Request, error) {
-	req, err := http.NewRequest("POST", path, body)
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Add("Authorization", "Bearer "+d.token)
-	req.Header.Add("Content-Type", "application/octet-stream")
-
-	if arg != "" {
-		req.Header.Add("Dropbox-API-Arg", arg)
-	}
+// accessToken returns the current access token.
+func (d *dropboxImpl) accessToken() string {
+	d.tokMu.Lock()
+	defer d.tokMu.Unlock()
+	return d.tok.AccessToken
+}
 
-	return req, nil
+// expired reports whether the current access token's expiry has passed.
+func (d *dropboxImpl) expired() bool {
+	d.tokMu.Lock()
+	defer d.tokMu.Unlock()
+	return d.tok.expired()
 }
 
-func (d *dropboxImpl) doRequest(req *http.Request) ([]byte, error) {
-	resp, err := d.client.Do(req)
+// refresh exchanges the current refresh token for a new access token,
+// updates tok, and persists the result via tokenStore.
+func (d *dropboxImpl) refresh() error {
+	d.tokMu.Lock()
+	defer d.tokMu.Unlock()
+
+	newTok, err := d.refresher.RefreshToken(d.tok.RefreshToken)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	refreshToken := newTok.RefreshToken
+	if refreshToken == "" {
+		// Dropbox does not always return a new refresh token; keep the
+		// one we already have in that case.
+		refreshToken = d.tok.RefreshToken
+	}
+	d.tok = tokenData{
+		AccessToken:  newTok.AccessToken,
+		RefreshToken: refreshToken,
+		Expiry:       newTok.Expiry,
+	}
+
+	enc, err := json.Marshal(d.tok)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return d.tokenStore.SaveToken(string(enc))
+}
+
+// maxRetries bounds the number of times dropboxTransport will retry a
+// request that fails with a rate-limit or server error.
+const maxRetries = 5
+
+// dropboxTransport is the http.RoundTripper underlying every SDK client's
+// http.Client. It adds the current bearer token and, if set, the
+// Dropbox-API-Path-Root header to every request; refreshes the token
+// proactively if its expiry has passed and reactively on a 401; and retries
+// on 429 (rate limited) and 5xx (server error) responses per the
+// Retry-After header. It also redirects requests to testServerURL when a
+// test has set one.
+type dropboxTransport struct {
+	d *dropboxImpl
+}
 
-	if resp.StatusCode == http.StatusConflict {
-		var dbxErr DropboxAPIError
-		err := json.Unmarshal(body, &dbxErr)
+func (t *dropboxTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	d := t.d
+
+	if d.testServerURL != "" {
+		u, err := url.Parse(d.testServerURL)
 		if err != nil {
 			return nil, err
 		}
-
-		return nil, dbxErr
+		req.URL.Scheme = u.Scheme
+		req.URL.Host = u.Host
 	}
 
-	if resp.StatusCode != 200 {
-		return nil, errors.Errorf("Dropbox API: %q, %q", resp.Status, body)
-	}
+	for attempt := 0; ; attempt++ {
+		r := req
+		if attempt > 0 {
+			r = req.Clone(req.Context())
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				r.Body = body
+			}
+		}
 
-	return body, nil
-}
+		if attempt == 0 && d.refresher != nil && d.expired() {
+			// The access token's expiry has passed; refresh proactively
+			// instead of waiting to be rejected with a 401. If this fails,
+			// fall through and let the reactive 401 path below retry it.
+			d.refresh()
+		}
 
-type DropboxAPIError struct {
-	ErrorSummary string `json:"error_summary"`
-}
+		r.Header.Set("Authorization", "Bearer "+d.accessToken())
+		if d.namespaceID != "" {
+			pathRoot, _ := json.Marshal(struct {
+				Tag         string `json:".tag"`
+				NamespaceID string `json:"namespace_id"`
+			}{"namespace_id", d.namespaceID})
+			r.Header.Set("Dropbox-API-Path-Root", string(pathRoot))
+		}
 
-func (e DropboxAPIError) StatusCode() int {
-	if strings.Contains(e.ErrorSummary, "not_found") {
-		return 404
-	}
+		resp, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil || attempt >= maxRetries {
+			return resp, err
+		}
 
-	return 0
-}
+		if resp.StatusCode == http.StatusUnauthorized && d.refresher != nil {
+			resp.Body.Close()
+			if rerr := d.refresh(); rerr != nil {
+				return resp, nil
+			}
+			continue
+		}
 
-func (e DropboxAPIError) Error() string {
-	return e.ErrorSummary
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+			resp.Body.Close()
+			if retryAfter == 0 {
+				retryAfter = 1
+			}
+			time.Sleep(time.Duration(retryAfter) * time.Second)
+			continue
+		}
+
+		return resp, nil
+	}
 }
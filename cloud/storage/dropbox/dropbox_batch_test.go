@@ -0,0 +1,129 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dropbox
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"upspin.io/upspin"
+)
+
+// TestDeleteBatch verifies that DeleteBatch issues a single delete_batch
+// call for all refs, polls delete_batch/check while the job is running,
+// and reports the one entry that failed.
+func TestDeleteBatch(t *testing.T) {
+	var checks int
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/2/files/delete_batch":
+			var arg struct {
+				Entries []struct {
+					Path string `json:"path"`
+				} `json:"entries"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&arg); err != nil {
+				t.Fatal(err)
+			}
+			if len(arg.Entries) != 2 {
+				t.Errorf("delete_batch: got %d entries, want 2", len(arg.Entries))
+			}
+			writeJSON(w, map[string]interface{}{
+				".tag":         "async_job_id",
+				"async_job_id": "job1",
+			})
+
+		case "/2/files/delete_batch/check":
+			checks++
+			if checks < 2 {
+				writeJSON(w, map[string]interface{}{".tag": "in_progress"})
+				return
+			}
+			writeJSON(w, map[string]interface{}{
+				".tag": "complete",
+				"complete": map[string]interface{}{
+					"entries": []map[string]interface{}{
+						{".tag": "success"},
+						{".tag": "failure"},
+					},
+				},
+			})
+
+		default:
+			t.Errorf("unexpected request to %q", r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+
+	d := newTestImpl(srv.URL, defaultChunkSize, 1)
+
+	refs := []upspin.Reference{"ref1", "ref2"}
+	result, err := d.deleteBatch(refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, failed := result["ref2"]; !failed || len(result) != 1 {
+		t.Errorf("got failed refs %v, want exactly {ref2}", result)
+	}
+	if checks != 2 {
+		t.Errorf("got %d delete_batch/check polls, want 2", checks)
+	}
+
+	if err := d.DeleteBatch(refs); err == nil {
+		t.Error("DeleteBatch: expected an error reporting the failed entry, got none")
+	}
+}
+
+// TestListPrefixRecursive verifies that ListPrefix targets the given
+// prefix folder and sets the recursive flag, unlike List.
+func TestListPrefixRecursive(t *testing.T) {
+	var gotPath string
+	var gotRecursive bool
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/2/files/list_folder":
+			var arg struct {
+				Path      string `json:"path"`
+				Recursive bool   `json:"recursive"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&arg); err != nil {
+				t.Fatal(err)
+			}
+			gotPath = arg.Path
+			gotRecursive = arg.Recursive
+			writeJSON(w, map[string]interface{}{
+				"entries": []map[string]interface{}{
+					{".tag": "file", "name": "a", "size": 1},
+				},
+				"cursor":   "",
+				"has_more": false,
+			})
+		default:
+			t.Errorf("unexpected request to %q", r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+
+	d := newTestImpl(srv.URL, defaultChunkSize, 1)
+	d.pathPrefix = "Apps/Upspin"
+
+	refs, _, err := d.ListPrefix("logs", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 || refs[0].Ref != "a" {
+		t.Errorf("got refs %v, want one ref named \"a\"", refs)
+	}
+	if want := "/Apps/Upspin/logs"; gotPath != want {
+		t.Errorf("got list_folder path %q, want %q", gotPath, want)
+	}
+	if !gotRecursive {
+		t.Error("got recursive=false, want true")
+	}
+}
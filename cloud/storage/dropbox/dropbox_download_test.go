@@ -0,0 +1,30 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dropbox
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"upspin.io/errors"
+)
+
+// TestDownloadNotFound verifies that a path/not_found download error is
+// reported as errors.NotExist, not errors.IO.
+func TestDownloadNotFound(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error_summary": "path/not_found/...", "error": {".tag": "path", "path": {".tag": "not_found"}}}`))
+	}))
+	defer srv.Close()
+
+	d := newTestImpl(srv.URL, defaultChunkSize, 1)
+
+	_, err := d.Download("myref")
+	if !errors.Is(errors.NotExist, err) {
+		t.Errorf("Download: got error %v, want errors.NotExist", err)
+	}
+}
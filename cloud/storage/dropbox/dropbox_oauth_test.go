@@ -0,0 +1,148 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dropbox
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"upspin.io/cloud/storage"
+)
+
+// fakeRefresher is a tokenRefresher that returns a scripted sequence of
+// tokens instead of calling out to Dropbox.
+type fakeRefresher struct {
+	tokens []*oauth2.Token
+	calls  int
+}
+
+func (f *fakeRefresher) RefreshToken(refreshToken string) (*oauth2.Token, error) {
+	tok := f.tokens[f.calls]
+	f.calls++
+	return tok, nil
+}
+
+// fakeTokenStore records every token it is asked to save.
+type fakeTokenStore struct {
+	saved []string
+}
+
+func (f *fakeTokenStore) SaveToken(tok string) error {
+	f.saved = append(f.saved, tok)
+	return nil
+}
+
+// TestDownloadRefreshesOnUnauthorized verifies that a 401 response causes
+// dropboxImpl to mint a new access token via its refresher, persist it, and
+// retry the request with the new token.
+func TestDownloadRefreshesOnUnauthorized(t *testing.T) {
+	var gotTokens []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotTokens = append(gotTokens, r.Header.Get("Authorization"))
+		if len(gotTokens) == 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("file contents"))
+	}))
+	defer srv.Close()
+
+	store := &fakeTokenStore{}
+	d := &dropboxImpl{
+		tok: tokenData{AccessToken: "stale-token", RefreshToken: "refresh-tok"},
+		refresher: &fakeRefresher{tokens: []*oauth2.Token{
+			{AccessToken: "fresh-token", RefreshToken: "refresh-tok", Expiry: time.Now().Add(time.Hour)},
+		}},
+		tokenStore:    store,
+		chunkSize:     defaultChunkSize,
+		testServerURL: srv.URL,
+	}
+	d.client = newSDKClient(d)
+
+	data, err := d.Download("myref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "file contents" {
+		t.Errorf("got %q, want %q", data, "file contents")
+	}
+
+	if want := []string{"Bearer stale-token", "Bearer fresh-token"}; !stringSliceEqual(gotTokens, want) {
+		t.Errorf("got tokens %v, want %v", gotTokens, want)
+	}
+	if len(store.saved) != 1 {
+		t.Fatalf("got %d saved tokens, want 1", len(store.saved))
+	}
+}
+
+// TestDownloadRefreshesProactivelyOnExpiry verifies that dropboxImpl
+// refreshes an access token whose expiry has already passed before sending
+// the request, rather than waiting to be rejected with a 401.
+func TestDownloadRefreshesProactivelyOnExpiry(t *testing.T) {
+	var gotTokens []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotTokens = append(gotTokens, r.Header.Get("Authorization"))
+		w.Write([]byte("file contents"))
+	}))
+	defer srv.Close()
+
+	store := &fakeTokenStore{}
+	d := &dropboxImpl{
+		tok: tokenData{AccessToken: "stale-token", RefreshToken: "refresh-tok", Expiry: time.Now().Add(-time.Minute)},
+		refresher: &fakeRefresher{tokens: []*oauth2.Token{
+			{AccessToken: "fresh-token", RefreshToken: "refresh-tok", Expiry: time.Now().Add(time.Hour)},
+		}},
+		tokenStore:    store,
+		chunkSize:     defaultChunkSize,
+		testServerURL: srv.URL,
+	}
+	d.client = newSDKClient(d)
+
+	data, err := d.Download("myref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "file contents" {
+		t.Errorf("got %q, want %q", data, "file contents")
+	}
+
+	if want := []string{"Bearer fresh-token"}; !stringSliceEqual(gotTokens, want) {
+		t.Errorf("got tokens %v, want %v", gotTokens, want)
+	}
+	if len(store.saved) != 1 {
+		t.Fatalf("got %d saved tokens, want 1", len(store.saved))
+	}
+}
+
+// TestNewParsesRefreshableToken verifies that New recognizes a JSON token
+// option with a refresh token and requires client_id/client_secret for it.
+func TestNewParsesRefreshableToken(t *testing.T) {
+	const tok = `{"access_token":"a","refresh_token":"r","expiry":"2030-01-01T00:00:00Z"}`
+
+	_, err := New(&storage.Opts{Opts: map[string]string{
+		"token": tok,
+	}})
+	if err == nil {
+		t.Error("expected an error for a refreshable token missing client_id/client_secret")
+	}
+}
+
+func stringSliceEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
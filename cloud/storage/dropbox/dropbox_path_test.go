@@ -0,0 +1,81 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dropbox
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestRefPathNested verifies that a non-empty pathPrefix is prepended to
+// every ref, and that List targets the prefix folder rather than the
+// account root.
+func TestRefPathNested(t *testing.T) {
+	d := &dropboxImpl{pathPrefix: "Apps/Upspin"}
+
+	if got, want := d.refPath("myref"), "/Apps/Upspin/myref"; got != want {
+		t.Errorf("refPath(%q) = %q, want %q", "myref", got, want)
+	}
+	if got, want := d.rootPath(), "/Apps/Upspin"; got != want {
+		t.Errorf("rootPath() = %q, want %q", got, want)
+	}
+}
+
+// TestNormalizePathPrefix verifies that normalizePathPrefix cleans slashes
+// and rejects ".." path segments.
+func TestNormalizePathPrefix(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"/", "", false},
+		{"Apps/Upspin", "Apps/Upspin", false},
+		{"/Apps/Upspin/", "Apps/Upspin", false},
+		{"../etc", "", true},
+		{"Apps/../etc", "", true},
+	}
+	for _, c := range cases {
+		got, err := normalizePathPrefix(c.in)
+		if (err != nil) != c.wantErr {
+			t.Errorf("normalizePathPrefix(%q) error = %v, wantErr %v", c.in, err, c.wantErr)
+			continue
+		}
+		if err == nil && got != c.want {
+			t.Errorf("normalizePathPrefix(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+// TestNamespaceIDHeader verifies that a non-empty namespaceID is sent as a
+// Dropbox-API-Path-Root header on every request.
+func TestNamespaceIDHeader(t *testing.T) {
+	var gotHeader string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeader = r.Header.Get("Dropbox-API-Path-Root")
+		w.Write([]byte("contents"))
+	}))
+	defer srv.Close()
+
+	d := &dropboxImpl{
+		tok:           tokenData{AccessToken: "tok"},
+		tokenStore:    noopTokenStore{},
+		chunkSize:     defaultChunkSize,
+		testServerURL: srv.URL,
+		namespaceID:   "ns123",
+	}
+	d.client = newSDKClient(d)
+
+	if _, err := d.Download("myref"); err != nil {
+		t.Fatal(err)
+	}
+
+	const want = `{".tag":"namespace_id","namespace_id":"ns123"}`
+	if gotHeader != want {
+		t.Errorf("got Dropbox-API-Path-Root header %q, want %q", gotHeader, want)
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dropbox
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// TestPutSessionChunking verifies that a payload larger than chunk_size is
+// uploaded via upload_session/start, one or more append_v2 calls, and
+// upload_session/finish, with each call advancing the cursor offset by
+// exactly the number of bytes in the previous chunk.
+func TestPutSessionChunking(t *testing.T) {
+	const chunkSize = 4
+	contents := []byte("0123456789AB") // 3 chunks of 4 bytes each
+
+	var mu sync.Mutex
+	var appendOffsets []uint64
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arg := dropboxAPIArg(t, r)
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch r.URL.Path {
+		case "/2/files/upload_session/start":
+			if arg["close"] != false {
+				t.Errorf("start: got close=%v, want false", arg["close"])
+			}
+			if len(body) != chunkSize {
+				t.Errorf("start: got %d bytes, want %d", len(body), chunkSize)
+			}
+			writeJSON(w, map[string]string{"session_id": "sess1"})
+
+		case "/2/files/upload_session/append_v2":
+			cursor := arg["cursor"].(map[string]interface{})
+			mu.Lock()
+			appendOffsets = append(appendOffsets, uint64(cursor["offset"].(float64)))
+			mu.Unlock()
+			if len(body) != chunkSize {
+				t.Errorf("append_v2: got %d bytes, want %d", len(body), chunkSize)
+			}
+			w.WriteHeader(http.StatusOK)
+
+		case "/2/files/upload_session/finish":
+			cursor := arg["cursor"].(map[string]interface{})
+			if got, want := uint64(cursor["offset"].(float64)), uint64(2*chunkSize); got != want {
+				t.Errorf("finish: got offset %d, want %d", got, want)
+			}
+			if len(body) != chunkSize {
+				t.Errorf("finish: got %d bytes, want %d", len(body), chunkSize)
+			}
+			writeJSON(w, map[string]string{})
+
+		default:
+			t.Errorf("unexpected request to %q", r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+
+	d := newTestImpl(srv.URL, chunkSize, 1)
+
+	if err := d.putSession("myref", contents); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []uint64{chunkSize}; !reflect.DeepEqual(appendOffsets, want) {
+		t.Errorf("got append offsets %v, want %v", appendOffsets, want)
+	}
+}
+
+// TestPutSessionRetry verifies that a 429 response from append_v2 is retried
+// after the Retry-After header's delay and eventually succeeds.
+func TestPutSessionRetry(t *testing.T) {
+	const chunkSize = 4
+	contents := []byte("012345678") // start, one append, then finish
+
+	var appendAttempts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/2/files/upload_session/start":
+			writeJSON(w, map[string]string{"session_id": "sess1"})
+		case "/2/files/upload_session/append_v2", "/2/files/upload_session/finish":
+			if r.URL.Path == "/2/files/upload_session/append_v2" {
+				appendAttempts++
+				if appendAttempts == 1 {
+					w.Header().Set("Retry-After", "0")
+					w.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+			}
+			writeJSON(w, map[string]string{})
+		default:
+			t.Errorf("unexpected request to %q", r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+
+	d := newTestImpl(srv.URL, chunkSize, 1)
+
+	if err := d.putSession("myref", contents); err != nil {
+		t.Fatal(err)
+	}
+	if appendAttempts != 2 {
+		t.Errorf("got %d append_v2 attempts, want 2", appendAttempts)
+	}
+}
+
+// TestPutSessionConcurrent verifies that a concurrent upload_session (a)
+// opens with an empty upload_session/start body, (b) appends every
+// non-final chunk as an exact multiple of concurrentChunkUnit, covering the
+// whole payload between them, and (c) finishes via finish_batch rather than
+// finish.
+func TestPutSessionConcurrent(t *testing.T) {
+	old := concurrentChunkUnit
+	concurrentChunkUnit = 4
+	defer func() { concurrentChunkUnit = old }()
+
+	const chunkSize = 4
+	contents := []byte("0123456789AB") // 3 chunks of 4 bytes each
+
+	var mu sync.Mutex
+	var appendOffsets []uint64
+	appendLens := make(map[uint64]int)
+	var finishBatchCalled bool
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch r.URL.Path {
+		case "/2/files/upload_session/start":
+			arg := dropboxAPIArg(t, r)
+			sessionType, _ := arg["session_type"].(map[string]interface{})
+			if sessionType == nil || sessionType[".tag"] != "concurrent" {
+				t.Errorf("start: got session_type %v, want concurrent", arg["session_type"])
+			}
+			if len(body) != 0 {
+				t.Errorf("start: got %d bytes, want 0 (a concurrent session must start empty)", len(body))
+			}
+			writeJSON(w, map[string]string{"session_id": "sess1"})
+
+		case "/2/files/upload_session/append_v2":
+			arg := dropboxAPIArg(t, r)
+			cursor := arg["cursor"].(map[string]interface{})
+			offset := uint64(cursor["offset"].(float64))
+			mu.Lock()
+			appendOffsets = append(appendOffsets, offset)
+			appendLens[offset] = len(body)
+			mu.Unlock()
+			w.WriteHeader(http.StatusOK)
+
+		case "/2/files/upload_session/finish_batch":
+			finishBatchCalled = true
+			writeJSON(w, map[string]interface{}{".tag": "complete"})
+
+		default:
+			t.Errorf("unexpected request to %q", r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+
+	d := newTestImpl(srv.URL, chunkSize, 4)
+
+	if err := d.putSession("myref", contents); err != nil {
+		t.Fatal(err)
+	}
+	if !finishBatchCalled {
+		t.Error("upload_session/finish_batch was never called")
+	}
+
+	sort.Slice(appendOffsets, func(i, j int) bool { return appendOffsets[i] < appendOffsets[j] })
+	wantOffsets := []uint64{0, 4, 8}
+	if !reflect.DeepEqual(appendOffsets, wantOffsets) {
+		t.Fatalf("got append offsets %v, want %v", appendOffsets, wantOffsets)
+	}
+	for i, offset := range appendOffsets {
+		if i == len(appendOffsets)-1 {
+			continue // the final chunk need not be a multiple of concurrentChunkUnit.
+		}
+		if n := appendLens[offset]; int64(n)%concurrentChunkUnit != 0 {
+			t.Errorf("append at offset %d: got %d bytes, want a multiple of %d", offset, n, concurrentChunkUnit)
+		}
+	}
+}
+
+// newTestImpl returns a dropboxImpl whose SDK client sends requests to srv,
+// for tests that exercise dropboxImpl's methods directly rather than
+// through New.
+func newTestImpl(srv string, chunkSize int64, concurrency int) *dropboxImpl {
+	d := &dropboxImpl{
+		tok:           tokenData{AccessToken: "tok"},
+		tokenStore:    noopTokenStore{},
+		chunkSize:     chunkSize,
+		concurrency:   concurrency,
+		testServerURL: srv,
+	}
+	d.client = newSDKClient(d)
+	return d
+}
+
+func dropboxAPIArg(t *testing.T, r *http.Request) map[string]interface{} {
+	t.Helper()
+	raw := r.Header.Get("Dropbox-API-Arg")
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &m); err != nil {
+		t.Fatalf("decoding Dropbox-API-Arg %q: %v", raw, err)
+	}
+	return m
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc, _ := json.Marshal(v)
+	w.Write(enc)
+}
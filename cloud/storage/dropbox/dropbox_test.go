@@ -31,6 +31,9 @@ var (
 )
 
 func TestList(t *testing.T) {
+	if !*useDropbox {
+		t.Skip("skipping live Dropbox test; pass -use_dropbox to enable")
+	}
 	ls, ok := client.(storage.Lister)
 	if !ok {
 		t.Fatal("impl does not provide List method")
@@ -95,6 +98,9 @@ func TestList(t *testing.T) {
 // storage in prod. However, since Dropbox is always available, we accept
 // to rely on it.
 func TestPutGetAndDownload(t *testing.T) {
+	if !*useDropbox {
+		t.Skip("skipping live Dropbox test; pass -use_dropbox to enable")
+	}
 	err := client.Put(fileName, testData)
 	if err != nil {
 		t.Fatal(err)
@@ -117,6 +123,9 @@ func TestPutGetAndDownload(t *testing.T) {
 }
 
 func TestDelete(t *testing.T) {
+	if !*useDropbox {
+		t.Skip("skipping live Dropbox test; pass -use_dropbox to enable")
+	}
 	err := client.Put(fileName, testData)
 	if err != nil {
 		t.Fatal(err)
@@ -136,8 +145,8 @@ func TestMain(m *testing.M) {
 	flag.Parse()
 	if !*useDropbox {
 		log.Printf(`
-cloud/storage/dropbox: skipping test as it requires Dropbox access. To enable this test,
-on the first run get an authentication code by visiting:
+cloud/storage/dropbox: skipping live Dropbox tests as they require Dropbox access. To
+enable them, on the first run get an authentication code by visiting:
 
 https://www.dropbox.com/oauth2/authorize?client_id=ufhy41x7g4obzqz&response_type=code
 
@@ -145,7 +154,7 @@ Copy the code and pass it by the -code flag. This will get an oAuth2 access toke
 it and reuse it in successive test calls.
 
 `)
-		os.Exit(0)
+		os.Exit(m.Run())
 	}
 
 	t, err := token()
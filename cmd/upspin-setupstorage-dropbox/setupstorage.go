@@ -8,6 +8,7 @@
 package main // import "dropbox.upspin.io/cmd/upspin-setupstorage-dropbox"
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -23,7 +24,11 @@ type state struct {
 	*subcmd.State
 }
 
-const help = `
+// help is built dynamically so that the authorization URL it prints always
+// requests token_access_type=offline, matching the Exchange call in
+// (*state).token; otherwise the code an operator obtains by following these
+// instructions would never yield a refresh token.
+var help = fmt.Sprintf(`
 Setupstorage-dropbox is the second step in establishing an upspinserver.
 It sets up Dropbox for your Upspin installation. You may skip this step
 if you wish to store Upspin data on your server's local disk.
@@ -33,11 +38,11 @@ the specified authorization code to access your Dropbox.
 
 Before running this command, you must obtain an authorization code:
 
-1. Go to https://www.dropbox.com/oauth2/authorize?client_id=wt1281n3q768jj3&response_type=code&state=state
+1. Go to %s
 2. Click "Allow" (you might have to log in first).
 3. Copy the authorization code
 4. Run setupstorage-dropbox -domain <domain.tld> <authorization_code>
-`
+`, dropboxOAuthConfig().AuthCodeURL("state", oauth2.SetAuthURLParam("token_access_type", "offline")))
 
 func main() {
 	const name = "setupstorage-dropbox"
@@ -51,6 +56,8 @@ func main() {
 
 	where := flag.String("where", filepath.Join(os.Getenv("HOME"), "upspin", "deploy"), "`directory` to store private configuration files")
 	domain := flag.String("domain", "", "domain `name` for this Upspin installation")
+	path := flag.String("path", "", "`path` prefix within the Dropbox account under which to store Upspin data")
+	namespaceID := flag.String("namespace_id", "", "Dropbox team `namespace` to store Upspin data in, if not the account root")
 
 	s.ParseFlags(flag.CommandLine, os.Args[1:], help,
 		"setupstorage-dropbox -domain=<name> <authorization_code>")
@@ -66,32 +73,86 @@ func main() {
 	cfgPath := filepath.Join(*where, *domain)
 	cfg := s.ReadServerConfig(cfgPath)
 
+	tok := s.token(authCode)
+	tokenFile := filepath.Join(cfgPath, tokenFileName)
+
 	cfg.StoreConfig = []string{
 		"backend=DROPBOX",
-		"token=" + s.token(authCode),
+		"client_id=" + dropboxClientID,
+		"client_secret=" + dropboxClientSecret,
+		"token=" + tok,
+		"token_file=" + tokenFile,
+	}
+	if *path != "" {
+		cfg.StoreConfig = append(cfg.StoreConfig, "path="+*path)
+	}
+	if *namespaceID != "" {
+		cfg.StoreConfig = append(cfg.StoreConfig, "namespace_id="+*namespaceID)
 	}
 	s.WriteServerConfig(cfgPath, cfg)
 
+	// Seed tokenFile with the token we just minted, so cloud/storage/dropbox
+	// finds a file in place to overwrite the first time it refreshes.
+	if err := os.WriteFile(tokenFile, []byte(tok), 0600); err != nil {
+		s.Exitf("error writing %q: %v", tokenFile, err)
+	}
+
 	fmt.Fprintf(os.Stderr, "You should now deploy the upspinserver binary and run 'upspin setupserver'.\n")
 
 	s.ExitNow()
 }
 
-func (s *state) token(code string) string {
-	conf := &oauth2.Config{
-		ClientID:     "wt1281n3q768jj3",
-		ClientSecret: "blk944sx4oyf6aq",
+// dropboxClientID and dropboxClientSecret identify the Dropbox app used by
+// this command. They are written into StoreConfig alongside the token so
+// that cloud/storage/dropbox can refresh the access token once it expires.
+const (
+	dropboxClientID     = "wt1281n3q768jj3"
+	dropboxClientSecret = "blk944sx4oyf6aq"
+)
+
+// tokenFileName is the name, within the server's configuration directory, of
+// the file that cloud/storage/dropbox rewrites whenever it refreshes the
+// access token, so that the refreshed token survives a server restart.
+const tokenFileName = "dropboxtoken.json"
+
+func dropboxOAuthConfig() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     dropboxClientID,
+		ClientSecret: dropboxClientSecret,
 		Endpoint: oauth2.Endpoint{
 			AuthURL:  "https://www.dropbox.com/oauth2/authorize",
 			TokenURL: "https://api.dropboxapi.com/oauth2/token",
 		},
 	}
-	conf.AuthCodeURL("state")
+}
+
+// storedToken is the JSON form of the "token" dial option, matching
+// cloud/storage/dropbox's tokenData.
+type storedToken struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Expiry       string `json:"expiry,omitempty"`
+}
+
+// token exchanges code for an offline-access OAuth2 token and returns it
+// JSON-encoded for storage in StoreConfig.
+func (s *state) token(code string) string {
+	conf := dropboxOAuthConfig()
+
+	tok, err := conf.Exchange(oauth2.NoContext, code,
+		oauth2.SetAuthURLParam("token_access_type", "offline"))
+	if err != nil {
+		s.Exitf("error in fetching oauth2 token: %v", err)
+	}
 
-	token, err := conf.Exchange(oauth2.NoContext, code)
+	enc, err := json.Marshal(storedToken{
+		AccessToken:  tok.AccessToken,
+		RefreshToken: tok.RefreshToken,
+		Expiry:       tok.Expiry.Format("2006-01-02T15:04:05Z07:00"),
+	})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error in fetching oauth2 token: %v.\n", err)
+		s.Exitf("error encoding oauth2 token: %v", err)
 	}
 
-	return token.AccessToken
+	return string(enc)
 }